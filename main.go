@@ -12,29 +12,117 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/fatih/color"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/term"
 )
 
 type config struct {
-	Groups map[string][]string `json:"groups"`
+	Groups           map[string]groupEntry `json:"-"`
+	RetryOnExitCodes []int                 `json:"retry_on_exit_codes"`
+}
+
+// groupEntry is a config group. It accepts either the original plain
+// array of dirs, or an object form with per-group env and shell settings:
+//
+//	"work": ["~/a", "~/b"]
+//	"work": {"dirs": ["~/a", "~/b"], "env": {"GOFLAGS": "-mod=vendor"}, "shell": true}
+type groupEntry struct {
+	Dirs  []string          `json:"dirs"`
+	Env   map[string]string `json:"env"`
+	Shell bool              `json:"shell"`
+}
+
+func (c *config) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Groups           map[string]json.RawMessage `json:"groups"`
+		RetryOnExitCodes []int                      `json:"retry_on_exit_codes"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	c.RetryOnExitCodes = raw.RetryOnExitCodes
+	c.Groups = map[string]groupEntry{}
+	for name, msg := range raw.Groups {
+		var dirs []string
+		if err := json.Unmarshal(msg, &dirs); err == nil {
+			c.Groups[name] = groupEntry{Dirs: dirs}
+			continue
+		}
+		var entry groupEntry
+		if err := json.Unmarshal(msg, &entry); err != nil {
+			return fmt.Errorf("group %q: %w", name, err)
+		}
+		c.Groups[name] = entry
+	}
+	return nil
 }
 
 // flags
 var (
-	fParallel = flag.Bool("parallel", false, "run commands concurrently")
-	fJobs     = flag.Int("j", runtime.NumCPU(), "max parallel jobs")
-	fDry      = flag.Bool("dry", false, "print what would run, don't actually run it")
-	fDirty    = flag.Bool("dirty", false, "only target git repos with uncommitted work")
-	fConfig   = flag.String("config", "", "path to config file")
-	fShell    = flag.Bool("shell", false, "wrap command in sh -c / cmd /c")
-	fQuiet    = flag.Bool("q", false, "suppress status lines, only show output")
+	fParallel     = flag.Bool("parallel", false, "run commands concurrently")
+	fJobs         = flag.Int("j", runtime.NumCPU(), "max parallel jobs")
+	fDry          = flag.Bool("dry", false, "print what would run, don't actually run it")
+	fDirty        = flag.Bool("dirty", false, "only target git repos with uncommitted work")
+	fConfig       = flag.String("config", "", "path to config file")
+	fShell        = flag.Bool("shell", false, "wrap command in sh -c / cmd /c")
+	fQuiet        = flag.Bool("q", false, "suppress status lines, only show output")
+	fFormat       = flag.String("format", "text", "output format: text, json, ndjson")
+	fRetry        = flag.Int("retry", 0, "retry a failing command up to N additional times")
+	fRetryDelay   = flag.Duration("retry-delay", 500*time.Millisecond, "base delay before the first retry")
+	fRetryBackoff = flag.Float64("retry-backoff", 2.0, "multiplier applied to -retry-delay after each failed attempt")
+	fOnBranch     = flag.String("on-branch", "", "only target repos currently on this branch")
+	fAhead        = flag.Bool("ahead", false, "only target repos ahead of their upstream")
+	fBehind       = flag.Bool("behind", false, "only target repos behind their upstream")
+	fHasStash     = flag.Bool("has-stash", false, "only target repos with stash entries")
+	fHasRemote    = flag.String("has-remote", "", "only target repos that have this remote configured")
+	fUntracked    = flag.Bool("untracked", false, "only target repos with untracked files")
+	fLogDir       = flag.String("log-dir", "", "also write each directory's output to PATH/<dir>.log")
+	fSplitStreams = flag.Bool("split-streams", false, "with -log-dir, write separate .stdout.log/.stderr.log files instead of one combined log")
+	fFailFast     = flag.Bool("fail-fast", false, "cancel remaining directories as soon as one fails")
+	fMaxFailures  = flag.Int("max-failures", 0, "cancel remaining directories once this many have failed (0 = unlimited)")
+	fKeepGoing    = flag.Bool("keep-going", false, "always run every directory, ignoring -fail-fast/-max-failures (default behavior)")
+	fTUI          = flag.Bool("tui", false, "live terminal dashboard instead of line-prefixed output (ignored on a non-terminal stdout)")
 )
 
+// retryableExitCodes holds the config's retry_on_exit_codes, if any; when
+// empty, every non-zero exit code is retried.
+var retryableExitCodes []int
+
+func retryable(code int) bool {
+	if len(retryableExitCodes) == 0 {
+		return true
+	}
+	for _, c := range retryableExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// structured is true when stdout/stderr must be captured per-directory
+// instead of prefixed straight to the terminal.
+func structured() bool {
+	return *fFormat == "json" || *fFormat == "ndjson"
+}
+
+// tuiActive is set once in main after checking stdout is actually a
+// terminal; tuiEvents is the channel run()/runOnce() publish lifecycle
+// events to instead of printing directly.
+var (
+	tuiActive bool
+	tuiEvents chan tuiEvent
+)
+
+func tuiOn() bool { return tuiActive }
+
 var outMu sync.Mutex
 
 func main() {
@@ -46,6 +134,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch *fFormat {
+	case "text", "json", "ndjson":
+	default:
+		die(fmt.Sprintf("unknown -format %q (want text, json, ndjson)", *fFormat))
+	}
+
 	args := flag.Args()
 	sep := indexOf(args, "--")
 	if sep < 0 {
@@ -62,7 +156,8 @@ func main() {
 	defer cancel()
 
 	cfg := findConfig(*fConfig)
-	dirs := resolve(targets, cfg)
+	retryableExitCodes = cfg.RetryOnExitCodes
+	dirs, dirGroup := resolve(targets, cfg)
 	if len(dirs) == 0 {
 		die("no directories matched")
 	}
@@ -75,7 +170,15 @@ func main() {
 		}
 	}
 
-	if !*fQuiet {
+	if filters := gitFilters(); len(filters) > 0 {
+		dirs = filterDirs(dirs, filters)
+		if len(dirs) == 0 {
+			fmt.Println("nothing matched the git filters")
+			return
+		}
+	}
+
+	if !*fQuiet && !structured() {
 		mode := "seq"
 		if *fParallel {
 			mode = fmt.Sprintf("parallel, %d workers", *fJobs)
@@ -83,31 +186,186 @@ func main() {
 		fmt.Printf("running in %d dirs (%s)\n", len(dirs), mode)
 	}
 
+	meta := buildMeta(dirs, dirGroup, cfg)
+
+	tuiActive = *fTUI && !structured() && term.IsTerminal(int(os.Stdout.Fd()))
+	var tuiDone chan struct{}
+	if tuiActive {
+		tuiEvents = make(chan tuiEvent, 64)
+		tuiDone = make(chan struct{})
+		go runTUI(dirs, tuiEvents, tuiDone)
+	}
+
 	t0 := time.Now()
-	ok, bad := execute(ctx, dirs, command)
+	ok, bad, results := execute(ctx, dirs, command, meta)
 	dt := time.Since(t0).Round(time.Millisecond)
 
-	if ctx.Err() != nil {
+	if tuiActive {
+		close(tuiEvents)
+		<-tuiDone
+		for _, d := range bad {
+			r := findResult(results, d)
+			if r == nil {
+				continue
+			}
+			if r.Skipped {
+				fmt.Printf("\n%s SKIP %s (never started)\n", color.HiBlackString("--"), d)
+				continue
+			}
+			fmt.Printf("\n%s FAIL %s\n", color.RedString("--"), d)
+			os.Stdout.WriteString(r.Stdout)
+			os.Stderr.WriteString(r.Stderr)
+		}
+	}
+
+	if ctx.Err() != nil && !structured() {
 		fmt.Fprintf(os.Stderr, "\ncancelled\n")
 	}
 
-	if !*fQuiet {
-		fmt.Printf("\ndone in %s — %d ok, %d failed\n", dt, ok, len(bad))
+	switch *fFormat {
+	case "json":
+		emitJSON(results)
+	case "ndjson":
+		// records were already emitted as they completed
+	default:
+		if !*fQuiet {
+			fmt.Printf("\ndone in %s — %d ok, %d failed\n", dt, ok, len(bad))
+		}
+		if len(bad) > 0 {
+			for _, d := range bad {
+				r := findResult(results, d)
+				if r != nil && r.Skipped {
+					fmt.Fprintf(os.Stderr, "  SKIP %s (never started)\n", d)
+					continue
+				}
+				suffix := ""
+				if r != nil && r.RetriedFailure {
+					suffix = fmt.Sprintf(" (failed after %d attempts)", r.Attempts)
+				}
+				fmt.Fprintf(os.Stderr, "  FAIL %s%s\n", d, suffix)
+			}
+		}
+	}
+
+	if *fLogDir != "" {
+		if err := writeLogSummary(results); err != nil {
+			fmt.Fprintf(os.Stderr, "log-dir: writing summary.json: %v\n", err)
+		}
 	}
 
 	if len(bad) > 0 {
-		for _, d := range bad {
-			fmt.Fprintf(os.Stderr, "  FAIL %s\n", d)
-		}
 		os.Exit(1)
 	}
 }
 
-func execute(ctx context.Context, dirs, command []string) (int, []string) {
+// writeLogSummary writes PATH/summary.json listing every directory's exit
+// code and duration, for diagnosing a run after the fact.
+func writeLogSummary(results []dirResult) error {
+	if err := os.MkdirAll(*fLogDir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(*fLogDir, "summary.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// dirResult is the structured record emitted per directory when
+// -format is json or ndjson.
+type dirResult struct {
+	Dir            string    `json:"dir"`
+	Base           string    `json:"base"`
+	Stdout         string    `json:"stdout,omitempty"`
+	Stderr         string    `json:"stderr,omitempty"`
+	ExitCode       int       `json:"exit_code"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Duration       string    `json:"duration"`
+	Error          string    `json:"error,omitempty"`
+	Attempts       int       `json:"attempts"`
+	RetriedFailure bool      `json:"retried_failure,omitempty"`
+	Skipped        bool      `json:"skipped,omitempty"`
+}
+
+type aggregate struct {
+	Results []dirResult `json:"results"`
+	OK      int         `json:"ok"`
+	Failed  int         `json:"failed"`
+	Skipped int         `json:"skipped"`
+}
+
+func findResult(results []dirResult, dir string) *dirResult {
+	for i := range results {
+		if results[i].Dir == dir {
+			return &results[i]
+		}
+	}
+	return nil
+}
+
+func emitJSON(results []dirResult) {
+	agg := aggregate{Results: results}
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			agg.Skipped++
+		case r.ExitCode != 0 || r.Error != "":
+			agg.Failed++
+		default:
+			agg.OK++
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(agg)
+}
+
+// dirMeta carries a directory's resolved group context: which group (if
+// any) pulled it in, plus that group's env and shell settings.
+type dirMeta struct {
+	Group string
+	Env   map[string]string
+	Shell bool
+}
+
+// buildMeta looks up each directory's group entry (if it was pulled in
+// via a group:name reference) to resolve its env and shell overrides.
+func buildMeta(dirs []string, dirGroup map[string]string, cfg config) map[string]dirMeta {
+	meta := make(map[string]dirMeta, len(dirs))
+	for _, d := range dirs {
+		group := dirGroup[d]
+		m := dirMeta{Group: group}
+		if entry, ok := cfg.Groups[group]; ok {
+			m.Env = entry.Env
+			m.Shell = entry.Shell
+		}
+		meta[d] = m
+	}
+	return meta
+}
+
+// failFast and maxFailures, if not overridden by -keep-going, reflect how
+// the pipeline reacts to a failing directory.
+func failFast() bool { return *fFailFast && !*fKeepGoing }
+func maxFailures() int {
+	if *fKeepGoing {
+		return 0
+	}
+	return *fMaxFailures
+}
+
+func execute(ctx context.Context, dirs, command []string, meta map[string]dirMeta) (int, []string, []dirResult) {
 	var (
-		mu   sync.Mutex
-		ok   int
-		bad  []string
+		mu      sync.Mutex
+		ok      int
+		bad     []string
+		results []dirResult
+		failed  int
 	)
 
 	limit := 1
@@ -115,75 +373,215 @@ func execute(ctx context.Context, dirs, command []string) (int, []string) {
 		limit = *fJobs
 	}
 
-	g, gctx := errgroup.WithContext(ctx)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g, gctx := errgroup.WithContext(runCtx)
 	g.SetLimit(limit)
 
 	for _, d := range dirs {
 		dir := d
 		g.Go(func() error {
-			err := run(gctx, dir, command)
+			res := run(gctx, dir, command, meta[dir])
+			isFail := res.ExitCode != 0 || res.Error != ""
+
 			mu.Lock()
-			if err != nil {
+			if isFail {
 				bad = append(bad, dir)
+				failed++
+				if n := maxFailures(); n > 0 && failed >= n {
+					cancel()
+				}
 			} else {
 				ok++
 			}
+			results = append(results, res)
+			if *fFormat == "ndjson" {
+				locked(func() {
+					_ = json.NewEncoder(os.Stdout).Encode(res)
+				})
+			}
 			mu.Unlock()
+
+			if isFail && failFast() {
+				return fmt.Errorf("%s: %s", dir, res.Error)
+			}
 			return nil
 		})
 	}
 	_ = g.Wait()
 
-	return ok, bad
+	return ok, bad, results
+}
+
+// run executes the command in dir, retrying on failure according to
+// -retry/-retry-delay/-retry-backoff. It returns the result of the last
+// attempt, annotated with how many attempts were made.
+func run(ctx context.Context, dir string, args []string, meta dirMeta) dirResult {
+	tag := color.CyanString("[%s]", filepath.Base(dir))
+	delay := *fRetryDelay
+
+	// A directory queued behind -j/-parallel's limit may never get its
+	// turn if -fail-fast or -max-failures already cancelled the run; treat
+	// that as skipped rather than a real failure with a misleading
+	// "context canceled" trace.
+	if ctx.Err() != nil {
+		now := time.Now()
+		res := dirResult{
+			Dir:      dir,
+			Base:     filepath.Base(dir),
+			Start:    now,
+			End:      now,
+			Duration: "0s",
+			Skipped:  true,
+			Error:    "skipped: run was cancelled before this directory started",
+		}
+		if tuiOn() {
+			publishTUI(tuiEvent{kind: tuiFinished, dir: dir, skipped: true})
+		} else if !*fQuiet && !structured() {
+			locked(func() { fmt.Printf("%s skipped\n", tag) })
+		}
+		return res
+	}
+
+	var res dirResult
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && tuiOn() {
+			publishTUI(tuiEvent{kind: tuiLine, dir: dir, line: fmt.Sprintf("attempt %d/%d", attempt, *fRetry+1)})
+		} else if attempt > 1 && !*fQuiet && !structured() {
+			locked(func() { fmt.Printf("%s attempt %d/%d\n", tag, attempt, *fRetry+1) })
+		}
+
+		res = runOnce(ctx, dir, args, meta, attempt)
+		res.Attempts = attempt
+
+		failed := res.ExitCode != 0 || res.Error != ""
+		if !failed || attempt > *fRetry || ctx.Err() != nil || !retryable(res.ExitCode) {
+			if failed && attempt > 1 {
+				res.RetriedFailure = true
+			}
+			return res
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return res
+		}
+		delay = time.Duration(float64(delay) * *fRetryBackoff)
+	}
 }
 
-func run(ctx context.Context, dir string, args []string) error {
+func runOnce(ctx context.Context, dir string, args []string, meta dirMeta, attempt int) dirResult {
 	tag := color.CyanString("[%s]", filepath.Base(dir))
+	res := dirResult{Dir: dir, Base: filepath.Base(dir), Start: time.Now()}
+
+	expanded := expandTemplate(args, dir, meta.Group)
 
 	if *fDry {
-		locked(func() { fmt.Printf("%s %s\n", tag, strings.Join(args, " ")) })
-		return nil
+		if tuiOn() {
+			publishTUI(tuiEvent{kind: tuiStarted, dir: dir})
+			publishTUI(tuiEvent{kind: tuiLine, dir: dir, line: strings.Join(expanded, " ")})
+			publishTUI(tuiEvent{kind: tuiFinished, dir: dir})
+		} else if !structured() {
+			locked(func() { fmt.Printf("%s %s\n", tag, strings.Join(expanded, " ")) })
+		}
+		res.End = time.Now()
+		res.Duration = res.End.Sub(res.Start).String()
+		return res
 	}
 
-	cmd := buildCmd(ctx, args)
+	cmd := buildCmd(ctx, expanded, meta)
 	cmd.Dir = dir
 
-	if !*fQuiet {
+	lf, err := openLogFiles(dir, attempt)
+	if err != nil {
+		locked(func() { fmt.Fprintf(os.Stderr, "%s log-dir: %v\n", tag, err) })
+	}
+	defer lf.close()
+
+	if tuiOn() {
+		publishTUI(tuiEvent{kind: tuiStarted, dir: dir})
+	} else if !*fQuiet && !structured() {
 		locked(func() { fmt.Printf("%s starting\n", tag) })
 	}
 
-	// pipe both stdout and stderr so we can prefix every line
+	// pipe both stdout and stderr so we can prefix every line (or, in
+	// structured mode, capture them separately into the result)
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		res.Error = err.Error()
+		res.ExitCode = -1
+		return res
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return err
+		res.Error = err.Error()
+		res.ExitCode = -1
+		return res
 	}
 
 	if err := cmd.Start(); err != nil {
-		locked(func() { fmt.Fprintf(os.Stderr, "%s start failed: %v\n", tag, err) })
-		return err
+		if !structured() {
+			locked(func() { fmt.Fprintf(os.Stderr, "%s start failed: %v\n", tag, err) })
+		}
+		res.Error = err.Error()
+		res.ExitCode = -1
+		res.End = time.Now()
+		res.Duration = res.End.Sub(res.Start).String()
+		return res
 	}
 
-	// drain both pipes concurrently
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	// drain both pipes concurrently, tee'ing to the log files if requested
 	var wg sync.WaitGroup
-	drain := func(r *bufio.Scanner) {
+	drain := func(r *bufio.Scanner, buf *bytes.Buffer, isErr bool) {
 		defer wg.Done()
 		for r.Scan() {
 			line := r.Text()
-			locked(func() { fmt.Printf("%s %s\n", tag, line) })
+			if structured() || tuiOn() {
+				buf.WriteString(line)
+				buf.WriteByte('\n')
+			}
+			if tuiOn() {
+				publishTUI(tuiEvent{kind: tuiLine, dir: dir, line: line})
+			} else if !structured() {
+				locked(func() { fmt.Printf("%s %s\n", tag, line) })
+			}
+			if isErr {
+				lf.writeStderr(line)
+			} else {
+				lf.writeStdout(line)
+			}
 		}
 	}
 
 	wg.Add(2)
-	go drain(bufio.NewScanner(stdoutPipe))
-	go drain(bufio.NewScanner(stderrPipe))
+	go drain(bufio.NewScanner(stdoutPipe), &stdoutBuf, false)
+	go drain(bufio.NewScanner(stderrPipe), &stderrBuf, true)
 	wg.Wait()
 
 	err = cmd.Wait()
-	if !*fQuiet {
+	res.End = time.Now()
+	res.Duration = res.End.Sub(res.Start).String()
+	if structured() || tuiOn() {
+		res.Stdout = stdoutBuf.String()
+		res.Stderr = stderrBuf.String()
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			res.ExitCode = exitErr.ExitCode()
+		} else {
+			res.ExitCode = -1
+		}
+	}
+
+	if tuiOn() {
+		publishTUI(tuiEvent{kind: tuiFinished, dir: dir, exitCode: res.ExitCode, err: res.Error})
+	} else if !*fQuiet && !structured() {
 		locked(func() {
 			if err != nil {
 				if ctx.Err() != nil {
@@ -196,15 +594,308 @@ func run(ctx context.Context, dir string, args []string) error {
 			}
 		})
 	}
-	return err
+	return res
+}
+
+// --- log-dir output capture ---
+
+// logFiles tees a directory's output to files under -log-dir, in addition
+// to whatever the terminal/structured-output path already does. A nil
+// *logFiles is valid and simply discards writes, so call sites don't need
+// to check -log-dir themselves.
+type logFiles struct {
+	combined *os.File
+	stdout   *os.File
+	stderr   *os.File
 }
 
-func buildCmd(ctx context.Context, args []string) *exec.Cmd {
-	if *fShell {
+// openLogFiles opens this directory's log file(s): the first attempt
+// truncates them, and later attempts open them for append, so that retried
+// attempts accumulate in the same file rather than each attempt truncating
+// the last one's output. A separator is written ahead of attempt 2 onward
+// so the log still reads as a sequence of attempts.
+func openLogFiles(dir string, attempt int) (*logFiles, error) {
+	if *fLogDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(*fLogDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// The first attempt of this invocation starts the log fresh, so output
+	// from a previous `runin -log-dir` run against the same directory
+	// doesn't linger unlabeled; later retry attempts within this same run
+	// append, separated by writeSeparator below.
+	open := func(path string) (*os.File, error) {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if attempt == 1 {
+			flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		}
+		return os.OpenFile(path, flags, 0o644)
+	}
+
+	name := sanitizeLogName(dir)
+	lf := &logFiles{}
+	var err error
+	if *fSplitStreams {
+		if lf.stdout, err = open(filepath.Join(*fLogDir, name+".stdout.log")); err != nil {
+			return nil, err
+		}
+		if lf.stderr, err = open(filepath.Join(*fLogDir, name+".stderr.log")); err != nil {
+			return nil, err
+		}
+	} else {
+		if lf.combined, err = open(filepath.Join(*fLogDir, name+".log")); err != nil {
+			return nil, err
+		}
+	}
+
+	if attempt > 1 {
+		lf.writeSeparator(attempt)
+	}
+	return lf, nil
+}
+
+func (lf *logFiles) writeSeparator(attempt int) {
+	if lf == nil {
+		return
+	}
+	for _, f := range []*os.File{lf.combined, lf.stdout, lf.stderr} {
+		if f != nil {
+			fmt.Fprintf(f, "--- attempt %d ---\n", attempt)
+		}
+	}
+}
+
+func (lf *logFiles) writeStdout(line string) {
+	if lf == nil {
+		return
+	}
+	if lf.stdout != nil {
+		fmt.Fprintln(lf.stdout, line)
+	}
+	if lf.combined != nil {
+		fmt.Fprintln(lf.combined, line)
+	}
+}
+
+func (lf *logFiles) writeStderr(line string) {
+	if lf == nil {
+		return
+	}
+	if lf.stderr != nil {
+		fmt.Fprintln(lf.stderr, line)
+	}
+	if lf.combined != nil {
+		fmt.Fprintln(lf.combined, line)
+	}
+}
+
+func (lf *logFiles) close() {
+	if lf == nil {
+		return
+	}
+	for _, f := range []*os.File{lf.combined, lf.stdout, lf.stderr} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// sanitizeLogName turns an absolute directory path into a flat filename
+// safe for use under -log-dir.
+func sanitizeLogName(dir string) string {
+	name := strings.TrimPrefix(dir, string(filepath.Separator))
+	name = strings.ReplaceAll(name, string(filepath.Separator), "_")
+	if name == "" {
+		name = "root"
+	}
+	return name
+}
+
+// --- TUI progress dashboard ---
+
+type tuiEventKind int
+
+const (
+	tuiStarted tuiEventKind = iota
+	tuiLine
+	tuiFinished
+)
+
+type tuiEvent struct {
+	kind     tuiEventKind
+	dir      string
+	line     string
+	exitCode int
+	err      string
+	skipped  bool
+}
+
+func publishTUI(ev tuiEvent) {
+	if tuiEvents != nil {
+		tuiEvents <- ev
+	}
+}
+
+type tuiRow struct {
+	state    string // queued, running, ok, failed, skipped
+	start    time.Time
+	lastLine string
+}
+
+// runTUI owns the terminal while a -tui run is in progress: it redraws a
+// one-row-per-directory dashboard on a timer and whenever an event
+// arrives, then signals done once the event channel is closed.
+func runTUI(dirs []string, events <-chan tuiEvent, done chan<- struct{}) {
+	defer close(done)
+
+	rows := make(map[string]*tuiRow, len(dirs))
+	for _, d := range dirs {
+		rows[d] = &tuiRow{state: "queued"}
+	}
+
+	ticker := time.NewTicker(150 * time.Millisecond)
+	defer ticker.Stop()
+
+	first := true
+	render := func() {
+		locked(func() {
+			drawTUI(dirs, rows, !first)
+			first = false
+		})
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				render()
+				return
+			}
+			r := rows[ev.dir]
+			switch ev.kind {
+			case tuiStarted:
+				r.state = "running"
+				r.start = time.Now()
+			case tuiLine:
+				r.lastLine = ev.line
+			case tuiFinished:
+				switch {
+				case ev.skipped:
+					r.state = "skipped"
+				case ev.exitCode != 0 || ev.err != "":
+					r.state = "failed"
+				default:
+					r.state = "ok"
+				}
+			}
+		case <-ticker.C:
+		}
+		render()
+	}
+}
+
+// drawTUI redraws the dashboard in place using ANSI cursor movement: one
+// row per directory plus a trailing aggregate progress line.
+func drawTUI(dirs []string, rows map[string]*tuiRow, reposition bool) {
+	if reposition {
+		fmt.Printf("\x1b[%dA", len(dirs)+1)
+	}
+
+	var done, failed, skipped int
+	for _, d := range dirs {
+		r := rows[d]
+		switch r.state {
+		case "ok":
+			done++
+		case "failed":
+			done++
+			failed++
+		case "skipped":
+			done++
+			skipped++
+		}
+
+		elapsed := ""
+		if !r.start.IsZero() {
+			elapsed = time.Since(r.start).Round(time.Second).String()
+		}
+
+		state := r.state
+		switch r.state {
+		case "ok":
+			state = color.GreenString("ok")
+		case "failed":
+			state = color.RedString("failed")
+		case "running":
+			state = color.YellowString("running")
+		case "skipped":
+			state = color.HiBlackString("skipped")
+		}
+
+		fmt.Printf("\x1b[2K[%-7s] %-20s %6s  %s\n", state, filepath.Base(d), elapsed, r.lastLine)
+	}
+
+	fmt.Printf("\x1b[2K%d/%d done, %d failed, %d skipped\n", done, len(dirs), failed, skipped)
+}
+
+func buildCmd(ctx context.Context, args []string, meta dirMeta) *exec.Cmd {
+	var cmd *exec.Cmd
+	if *fShell || meta.Shell {
 		sh, shflag := shellCmd()
-		return exec.CommandContext(ctx, sh, shflag, strings.Join(args, " "))
+		cmd = exec.CommandContext(ctx, sh, shflag, strings.Join(args, " "))
+	} else {
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	}
+
+	if len(meta.Env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range meta.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+
+	return cmd
+}
+
+// expandTemplate replaces {dir}, {base}, {group}, {branch}, and {remote}
+// placeholders in each arg with values resolved for that directory.
+func expandTemplate(args []string, dir, group string) []string {
+	needsAny := false
+	for _, a := range args {
+		if strings.Contains(a, "{") {
+			needsAny = true
+			break
+		}
 	}
-	return exec.CommandContext(ctx, args[0], args[1:]...)
+	if !needsAny {
+		return args
+	}
+
+	joined := strings.Join(args, "\x00")
+	pairs := []string{
+		"{dir}", dir,
+		"{base}", filepath.Base(dir),
+		"{group}", group,
+	}
+	if strings.Contains(joined, "{branch}") {
+		pairs = append(pairs, "{branch}", gitBranch(dir))
+	}
+	if strings.Contains(joined, "{remote}") {
+		pairs = append(pairs, "{remote}", gitRemoteURL(dir, "origin"))
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	out := make([]string, len(args))
+	for i, a := range args {
+		if !strings.Contains(a, "{") {
+			out[i] = a
+			continue
+		}
+		out[i] = replacer.Replace(a)
+	}
+	return out
 }
 
 func shellCmd() (string, string) {
@@ -216,12 +907,15 @@ func shellCmd() (string, string) {
 
 // --- directory resolution ---
 
-func resolve(patterns []string, cfg config) []string {
+// resolve expands targets (paths, globs, group:name references) into
+// absolute directories, and records which group (if any) pulled each
+// one in so its env/shell settings can be applied later.
+func resolve(patterns []string, cfg config) (dirs []string, dirGroup map[string]string) {
 	seen := map[string]bool{}
-	var out []string
+	dirGroup = map[string]string{}
 
-	var walk func(string, int)
-	walk = func(pat string, depth int) {
+	var walk func(pat, group string, depth int)
+	walk = func(pat, group string, depth int) {
 		if depth > 10 {
 			return
 		}
@@ -229,9 +923,9 @@ func resolve(patterns []string, cfg config) []string {
 		// group reference
 		if strings.HasPrefix(pat, "group:") {
 			name := pat[6:]
-			if entries, ok := cfg.Groups[name]; ok {
-				for _, e := range entries {
-					walk(e, depth+1)
+			if entry, ok := cfg.Groups[name]; ok {
+				for _, e := range entry.Dirs {
+					walk(e, name, depth+1)
 				}
 			}
 			return
@@ -250,15 +944,16 @@ func resolve(patterns []string, cfg config) []string {
 			}
 			if !seen[abs] {
 				seen[abs] = true
-				out = append(out, abs)
+				dirs = append(dirs, abs)
+				dirGroup[abs] = group
 			}
 		}
 	}
 
 	for _, p := range patterns {
-		walk(p, 0)
+		walk(p, "", 0)
 	}
-	return out
+	return dirs, dirGroup
 }
 
 func expandPath(p string) string {
@@ -307,6 +1002,130 @@ func gitOut(dir string, args ...string) ([]byte, error) {
 	return cmd.Output()
 }
 
+// --- general git filters ---
+
+// gitFilters builds the AND-composed predicate list implied by the
+// -on-branch/-ahead/-behind/-has-stash/-has-remote/-untracked flags.
+func gitFilters() []func(string) bool {
+	var filters []func(string) bool
+
+	if *fOnBranch != "" {
+		want := *fOnBranch
+		filters = append(filters, func(d string) bool {
+			return gitBranch(d) == want
+		})
+	}
+	if *fAhead {
+		filters = append(filters, func(d string) bool {
+			ahead, _, ok := gitAheadBehind(d)
+			return ok && ahead > 0
+		})
+	}
+	if *fBehind {
+		filters = append(filters, func(d string) bool {
+			_, behind, ok := gitAheadBehind(d)
+			return ok && behind > 0
+		})
+	}
+	if *fHasStash {
+		filters = append(filters, gitHasStash)
+	}
+	if *fHasRemote != "" {
+		want := *fHasRemote
+		filters = append(filters, func(d string) bool {
+			return gitHasRemote(d, want)
+		})
+	}
+	if *fUntracked {
+		filters = append(filters, gitHasUntracked)
+	}
+
+	return filters
+}
+
+func filterDirs(dirs []string, filters []func(string) bool) []string {
+	var out []string
+	for _, d := range dirs {
+		match := true
+		for _, f := range filters {
+			if !f(d) {
+				match = false
+				break
+			}
+		}
+		if match {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func gitBranch(dir string) string {
+	out, err := gitOut(dir, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitAheadBehind reports how many commits HEAD is ahead of and behind its
+// upstream. ok is false if the repo has no upstream or git failed.
+func gitAheadBehind(dir string) (ahead, behind int, ok bool) {
+	out, err := gitOut(dir, "rev-list", "--count", "@{u}..HEAD")
+	if err != nil {
+		return 0, 0, false
+	}
+	ahead, err = strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	out, err = gitOut(dir, "rev-list", "--count", "HEAD..@{u}")
+	if err != nil {
+		return 0, 0, false
+	}
+	behind, err = strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return ahead, behind, true
+}
+
+func gitHasStash(dir string) bool {
+	out, err := gitOut(dir, "stash", "list")
+	if err != nil {
+		return false
+	}
+	return len(bytes.TrimSpace(out)) > 0
+}
+
+func gitHasRemote(dir, name string) bool {
+	_, err := gitOut(dir, "remote", "get-url", name)
+	return err == nil
+}
+
+func gitRemoteURL(dir, name string) string {
+	out, err := gitOut(dir, "remote", "get-url", name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func gitHasUntracked(dir string) bool {
+	out, err := gitOut(dir, "status", "--porcelain", "--untracked-files=normal")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "??") {
+			return true
+		}
+	}
+	return false
+}
+
 // --- config loading ---
 
 func findConfig(explicit string) config {
@@ -333,7 +1152,7 @@ func findConfig(explicit string) config {
 			return c
 		}
 	}
-	return config{Groups: map[string][]string{}}
+	return config{Groups: map[string]groupEntry{}}
 }
 
 func stripLineComments(data []byte) []byte {
@@ -390,4 +1209,11 @@ func usage() {
 	fmt.Fprintln(w, "  runin -parallel -j4 services/* -- make test")
 	fmt.Fprintln(w, "  runin -dirty group:work -- git status -s")
 	fmt.Fprintln(w, "  runin -shell dev/* -- 'npm install && npm test'")
-}
\ No newline at end of file
+	fmt.Fprintln(w, "  runin -format ndjson services/* -- make test | jq .")
+	fmt.Fprintln(w, "  runin -retry 3 -retry-delay 1s -retry-backoff 2 repos/* -- git pull")
+	fmt.Fprintln(w, "  runin -on-branch main -ahead repos/* -- git push")
+	fmt.Fprintln(w, "  runin group:work -- echo '{group}/{base} is on {branch}'")
+	fmt.Fprintln(w, "  runin -parallel -j8 -log-dir ./logs services/* -- make test")
+	fmt.Fprintln(w, "  runin -parallel -j16 -fail-fast services/* -- make test")
+	fmt.Fprintln(w, "  runin -parallel -j8 -tui services/* -- make test")
+}